@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+)
+
+// 具体的状态类型无法仅凭 JSON 还原出来, FactoryRegistry 把类型名字映射到构造函数,
+// 加载定义文件时按名字找到构造函数来实例化状态
+type FactoryRegistry struct {
+	ctors map[string]func() State
+}
+
+func NewFactoryRegistry() *FactoryRegistry {
+	return &FactoryRegistry{ctors: make(map[string]func() State)}
+}
+
+// 注册一个类型名对应的构造函数, 名字通常就是该状态最终在 StateManager 里的名字
+func (r *FactoryRegistry) Register(typeName string, ctor func() State) {
+	r.ctors[typeName] = ctor
+}
+
+func (r *FactoryRegistry) New(typeName string) (State, error) {
+	ctor, ok := r.ctors[typeName]
+	if !ok {
+		return nil, fmt.Errorf("factory not registered for state type: %s", typeName)
+	}
+
+	return ctor(), nil
+}
+
+// 定义文件的 JSON 结构: 状态列表, 允许的转移, 初始状态
+type stateManagerDef struct {
+	Initial     string          `json:"initial,omitempty"`
+	States      []stateDef      `json:"states"`
+	Transitions []transitionDef `json:"transitions,omitempty"`
+	// 对应 StateManager.history: 每个启用了历史记忆的父状态最近一次激活的子状态, 不恢复
+	// 这个字段的话, 复合状态在 UnmarshalJSON 之后会"忘记"上次去过哪个子状态, 重新进入时
+	// 只能退回 InitialChild
+	History map[string]string `json:"history,omitempty"`
+}
+
+type stateDef struct {
+	// 同时也是该状态在 StateManager 里的名字, 对应 FactoryRegistry 里注册的类型名
+	Type              string `json:"type"`
+	EnableSameTransit *bool  `json:"enableSameTransit,omitempty"`
+}
+
+type transitionDef struct {
+	// 空字符串表示适用于任意状态(AddTransitionAny)
+	From string `json:"from,omitempty"`
+	To   string `json:"to"`
+	// guard 函数无法被序列化, 这里只存它在 Guards 注册表里的名字, action 不支持导入导出
+	Guard string `json:"guard,omitempty"`
+}
+
+// 加载定义文件时找不到对应 guard 名字
+var ErrGuardNotRegistered = fmt.Errorf("guard not registered.")
+
+// 加载定义文件前没有提供 FactoryRegistry
+var ErrFactoryRegistryRequired = fmt.Errorf("factory registry required to unmarshal state manager.")
+
+// MarshalJSON 导出当前已注册的状态, 声明式转移表和当前状态, 可以配合 UnmarshalJSON 做还原
+func (sm *StateManager) MarshalJSON() ([]byte, error) {
+	sm.mu.RLock()
+	var currName string
+	if sm.curr != nil {
+		currName = sm.curr.Name()
+	}
+
+	names := make([]string, 0, len(sm.stateByName))
+	for name := range sm.stateByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	states := make([]State, len(names))
+	for i, name := range names {
+		states[i] = sm.stateByName[name]
+	}
+
+	transitions := append([]*transitionRule(nil), sm.transitions...)
+
+	history := make(map[string]string, len(sm.history))
+	for parent, child := range sm.history {
+		history[parent] = child
+	}
+	sm.mu.RUnlock()
+
+	def := stateManagerDef{Initial: currName, History: history}
+
+	for i, name := range names {
+		enableSameTransit := states[i].EnableSameTransit()
+		def.States = append(def.States, stateDef{Type: name, EnableSameTransit: &enableSameTransit})
+	}
+
+	for _, t := range transitions {
+		def.Transitions = append(def.Transitions, transitionDef{
+			From:  t.From,
+			To:    t.To,
+			Guard: sm.guardName(t.Guard),
+		})
+	}
+
+	return json.Marshal(def)
+}
+
+// 在 Guards 注册表里反查一个 guard 函数对应的名字, 找不到就返回空字符串
+func (sm *StateManager) guardName(guard func() bool) string {
+	if guard == nil {
+		return ""
+	}
+
+	sm.mu.RLock()
+	guards := sm.Guards
+	sm.mu.RUnlock()
+
+	guardPtr := reflect.ValueOf(guard).Pointer()
+	for name, g := range guards {
+		if reflect.ValueOf(g).Pointer() == guardPtr {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// UnmarshalJSON 按定义文件重建状态机: Factories 用来实例化具体的状态类型,
+// Guards 用来把转移表里按名字引用的 guard 接回真正的函数, 调用前需要先设置好这两个字段
+func (sm *StateManager) UnmarshalJSON(data []byte) error {
+	var def stateManagerDef
+	if err := json.Unmarshal(data, &def); err != nil {
+		return err
+	}
+
+	sm.mu.RLock()
+	factories := sm.Factories
+	guards := sm.Guards
+	needsInit := sm.stateByName == nil
+	sm.mu.RUnlock()
+
+	if factories == nil {
+		return ErrFactoryRegistryRequired
+	}
+
+	if needsInit {
+		sm.mu.Lock()
+		if sm.stateByName == nil {
+			sm.stateByName = make(map[string]State)
+		}
+		sm.mu.Unlock()
+	}
+
+	for _, sd := range def.States {
+		s, err := factories.New(sd.Type)
+		if err != nil {
+			return err
+		}
+
+		sm.addNamed(sd.Type, s)
+
+		if sd.EnableSameTransit != nil {
+			if setter, ok := s.(interface{ setEnableSameTransit(enable bool) }); ok {
+				setter.setEnableSameTransit(*sd.EnableSameTransit)
+			}
+		}
+	}
+
+	for _, td := range def.Transitions {
+		var guard func() bool
+		if td.Guard != "" {
+			g, ok := guards[td.Guard]
+			if !ok {
+				return ErrGuardNotRegistered
+			}
+			guard = g
+		}
+
+		sm.AddTransition(td.From, td.To, guard, nil)
+	}
+
+	if len(def.History) > 0 {
+		sm.mu.Lock()
+		if sm.history == nil {
+			sm.history = make(map[string]string, len(def.History))
+		}
+		for parent, child := range def.History {
+			sm.history[parent] = child
+		}
+		sm.mu.Unlock()
+	}
+
+	if def.Initial != "" {
+		if err := sm.Transit(def.Initial); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ExportDOT 把已注册的状态和声明式转移表导出为 Graphviz DOT 格式(digraph), 可以直接喂给
+// `dot` 渲染成图, 用来调试实际的游戏/工作流状态机. AddTransitionAny 注册的转移(From 为空)
+// 会展开成从每个状态(目标状态自身除外)出发的一条边
+func (sm *StateManager) ExportDOT(w io.Writer) error {
+	sm.mu.RLock()
+	var currName string
+	if sm.curr != nil {
+		currName = sm.curr.Name()
+	}
+
+	names := make([]string, 0, len(sm.stateByName))
+	for name := range sm.stateByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	transitions := append([]*transitionRule(nil), sm.transitions...)
+	sm.mu.RUnlock()
+
+	if _, err := fmt.Fprintln(w, "digraph FSM {"); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		attrs := ""
+		if name == currName {
+			attrs = " [style=filled, fillcolor=lightgrey]"
+		}
+
+		if _, err := fmt.Fprintf(w, "\t%q%s;\n", name, attrs); err != nil {
+			return err
+		}
+	}
+
+	for _, t := range transitions {
+		froms := []string{t.From}
+		isAny := t.From == ""
+		if isAny {
+			froms = names
+		}
+
+		label := sm.guardName(t.Guard)
+
+		for _, from := range froms {
+			// t.From == "" 展开成每个状态出发的一条边时, 跳过指向自己的那条, 因为
+			// AddTransitionAny 并不代表状态能自己转移到自己; 显式声明的自转移规则(EnableSameTransit)
+			// 仍然要画出来
+			if isAny && from == t.To {
+				continue
+			}
+
+			if label == "" {
+				if _, err := fmt.Fprintf(w, "\t%q -> %q;\n", from, t.To); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if _, err := fmt.Fprintf(w, "\t%q -> %q [label=%q];\n", from, t.To, label); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"os"
 	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type State interface {
@@ -20,6 +26,16 @@ type State interface {
 
 	// 判断能够转移到某个状态
 	CanTransitTo(name string) bool
+
+	// 父状态的名字, 空字符串表示没有父状态
+	Parent() string
+
+	// 该状态(作为父状态时)是否记住上一次激活的子状态
+	EnableHistory() bool
+
+	// 该状态(作为父状态时)第一次被进入、还没有历史记忆可以回去时, 默认进入的子状态名,
+	// 空字符串表示没有子状态(自己就是叶子状态)
+	InitialChild() string
 }
 
 func StateName(s State) string {
@@ -33,6 +49,10 @@ func StateName(s State) string {
 // 一个默认的实现, 提供基础行为
 type StateInfo struct {
 	name string
+
+	// 是否允许同状态转移, 供从定义文件加载的状态使用, 重写了 EnableSameTransit
+	// 的具体状态类型(如 MoveState)会忽略这个字段
+	enableSameTransit bool
 }
 
 // 状态名
@@ -45,9 +65,14 @@ func (s *StateInfo) setName(name string) {
 	s.name = name
 }
 
-// 不允许同状态转移
+// 默认不允许同状态转移, 可以通过 setEnableSameTransit 改变
 func (s *StateInfo) EnableSameTransit() bool {
-	return false
+	return s.enableSameTransit
+}
+
+// 提供给定义文件加载器设置该字段
+func (s *StateInfo) setEnableSameTransit(enable bool) {
+	s.enableSameTransit = enable
 }
 
 // 默认状态开启时的实现
@@ -63,26 +88,280 @@ func (s *StateInfo) CanTransitTo(name string) bool {
 	return true
 }
 
+// 默认没有父状态
+func (s *StateInfo) Parent() string {
+	return ""
+}
+
+// 默认不记住上一次激活的子状态
+func (s *StateInfo) EnableHistory() bool {
+	return false
+}
+
+// 默认没有子状态, 自己就是叶子状态
+func (s *StateInfo) InitialChild() string {
+	return ""
+}
+
 type StateManager struct {
+	// 保护下面这些字段的并发访问, 读方法持读锁, 写方法持写锁, 调用用户代码(OnBegin/OnEnd/
+	// 回调/guard/action)时一定不持有这个锁, 避免用户代码回调回 StateManager 时死锁
+	mu sync.RWMutex
+
+	// 串行化整个 Transit 调用(包括里面对 OnEnd/OnBegin 的调用), 保证两个 goroutine
+	// 同时发起转移时不会交错执行
+	transitMu sync.Mutex
+
 	// 已经添加的状态
 	stateByName map[string]State
 
-	// 状态改变时的回调
-	OnChange func(from, to State)
-
-	// 当前状态
+	// 当前状态(叶子状态)
 	curr State
+
+	// 当前激活的状态链, 从根状态到叶子状态(curr)
+	activeChain []State
+
+	// 记录每个启用了历史记忆的父状态最近一次激活的子状态
+	history map[string]string
+
+	// 声明式的转移表, 按注册顺序存放
+	transitions []*transitionRule
+
+	// 按状态名/事件名注册的事件处理器
+	eventHandlers map[string]map[string]func(payload interface{}) (string, error)
+
+	// 待处理的事件队列, Fire 往里投递, Run 从里取出处理
+	events chan Event
+
+	// 处理事件时返回了错误(包括找不到处理器), Run 会把它报告到这里
+	OnEventError func(ev Event, err error)
+
+	// 从 JSON 定义文件恢复状态机时, 用它按类型名实例化具体的状态, UnmarshalJSON 之前必须设置
+	Factories *FactoryRegistry
+
+	// 从 JSON 定义文件恢复状态机时, 按名字把转移表里引用的 guard 接回真正的函数
+	Guards map[string]func() bool
+
+	// History() 保留的转移记录条数上限, 超出的部分按先进先出丢弃. NewStateManager 会把它
+	// 设成 defaultTransitionHistory, 留空(零值)时 Transit 也会退回这个默认值
+	HistoryCap int
+
+	// 按注册顺序存放的状态改变观察者, 用 Subscribe 添加
+	observers []*observer
+
+	// 下一个观察者的 id, 用于 Subscribe 返回的 unsubscribe 定位自己
+	nextObserverID int
+
+	// Watch 返回的只读 channel, 懒创建
+	watch chan Transition
+
+	// 最近 HistoryCap 条转移记录, 按发生顺序存放, 超出上限时丢弃最旧的一条
+	records []TransitionRecord
+
+	// 进入当前状态(curr)的时间, 用于下次转移时算出在它里面停留了多久
+	enteredAt time.Time
+
+	// 每个状态名到目前为止累计停留的时长, 不包含还未结束的这一次停留
+	timeInState map[string]time.Duration
+}
+
+// Subscribe/Watch 通知的一次状态改变
+type Transition struct {
+	From State
+	To   State
+}
+
+type observer struct {
+	id int
+	fn func(from, to State)
+}
+
+// StateManager.HistoryCap 留空时使用的默认值
+const defaultTransitionHistory = 32
+
+// 一条转移记录: At 是转移发生的时刻, Duration 是转移前在 From 状态中停留的时长
+type TransitionRecord struct {
+	From     string
+	To       string
+	At       time.Time
+	Duration time.Duration
+}
+
+// 事件队列的默认容量, 足够容纳一次调度中从 OnBegin/OnEnd 里再次 Fire 的事件, 避免递归
+const eventQueueSize = 64
+
+// 一个事件: 名字加上任意负载
+type Event struct {
+	Name    string
+	Payload interface{}
+}
+
+// 一条声明式转移规则. From 为空字符串表示适用于任意当前状态(AddTransitionAny)
+type transitionRule struct {
+	From   string
+	To     string
+	Guard  func() bool
+	Action func()
+}
+
+// 未能通过声明式转移表守卫而被拒绝的转移. 同一个 From -> To 可以匹配多条规则(包括
+// AddTransitionAny 注册的), RuleIndex 是拒绝它的那条规则在 sm.transitions 里按注册顺序
+// (即第几次 AddTransition/AddTransitionAny 调用)的下标, GuardName 是该 guard 在 Guards
+// 注册表里对应的名字(没有注册时为空), 两者结合起来才能在多条规则匹配同一对端点时分辨
+// 到底是哪一个 guard 拒绝的
+type TransitionRejectedError struct {
+	From      string
+	To        string
+	RuleIndex int
+	GuardName string
+}
+
+func (e *TransitionRejectedError) Error() string {
+	if e.GuardName != "" {
+		return fmt.Sprintf("transition rejected by guard %q (rule #%d): %s -> %s", e.GuardName, e.RuleIndex, e.From, e.To)
+	}
+
+	return fmt.Sprintf("transition rejected by guard (rule #%d): %s -> %s", e.RuleIndex, e.From, e.To)
+}
+
+// 注册一条从 from 到 to 的声明式转移: guard 决定是否放行, action 在 OnEnd 和 OnBegin 之间执行,
+// 两者都可以为 nil
+func (sm *StateManager) AddTransition(from, to string, guard func() bool, action func()) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.transitions = append(sm.transitions, &transitionRule{From: from, To: to, Guard: guard, Action: action})
+}
+
+// 注册一条从任意状态到 to 的声明式转移
+func (sm *StateManager) AddTransitionAny(to string, guard func() bool, action func()) {
+	sm.AddTransition("", to, guard, action)
+}
+
+// 一条匹配到的转移规则, 连同它在 sm.transitions 里按注册顺序的下标, 用来在多条规则
+// 匹配同一对端点时定位到具体是哪一次 AddTransition/AddTransitionAny 调用
+type matchedTransitionRule struct {
+	Index int
+	Rule  *transitionRule
+}
+
+// 找出从 from 到 to 匹配的声明式转移规则, 按注册顺序返回, 附带它们在 sm.transitions 里的下标
+func (sm *StateManager) transitionRulesTo(from, to string) []matchedTransitionRule {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	var matched []matchedTransitionRule
+	for i, t := range sm.transitions {
+		if t.To == to && (t.From == "" || t.From == from) {
+			matched = append(matched, matchedTransitionRule{Index: i, Rule: t})
+		}
+	}
+
+	return matched
+}
+
+// 当前状态下, 声明式转移表中可以前往的目标状态(守卫当前通过的)
+func (sm *StateManager) PossibleTransitions() []string {
+	sm.mu.RLock()
+	from := ""
+	if sm.curr != nil {
+		from = sm.curr.Name()
+	}
+	transitions := append([]*transitionRule(nil), sm.transitions...)
+	sm.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	var result []string
+	for _, t := range transitions {
+		if t.From != "" && t.From != from {
+			continue
+		}
+
+		// guard 是用户代码, 在锁外面调用
+		if t.Guard != nil && !t.Guard() {
+			continue
+		}
+
+		if !seen[t.To] {
+			seen[t.To] = true
+			result = append(result, t.To)
+		}
+	}
+
+	return result
+}
+
+// Subscribe 注册一个状态改变的观察者, 按注册顺序在 OnBegin 返回之后被调用, 返回的 unsubscribe
+// 用来取消这次订阅
+func (sm *StateManager) Subscribe(fn func(from, to State)) (unsubscribe func()) {
+	sm.mu.Lock()
+	id := sm.nextObserverID
+	sm.nextObserverID++
+	sm.observers = append(sm.observers, &observer{id: id, fn: fn})
+	sm.mu.Unlock()
+
+	return func() {
+		sm.mu.Lock()
+		defer sm.mu.Unlock()
+
+		for i, o := range sm.observers {
+			if o.id == id {
+				sm.observers = append(sm.observers[:i:i], sm.observers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// Watch 返回的 channel 缓冲大小, 消费者来不及处理时多余的 Transition 会被丢弃而不是阻塞 Transit
+const watchQueueSize = 16
+
+// Watch 返回一个只读 channel, 每次转移成功后都会往里投递一条 Transition, 投递是非阻塞的
+func (sm *StateManager) Watch() <-chan Transition {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if sm.watch == nil {
+		sm.watch = make(chan Transition, watchQueueSize)
+	}
+
+	return sm.watch
+}
+
+// notify 把一次转移广播给所有订阅者和 Watch 的消费者, 调用前不能持有 sm.mu
+func (sm *StateManager) notify(from, to State) {
+	sm.mu.RLock()
+	observers := append([]*observer(nil), sm.observers...)
+	watch := sm.watch
+	sm.mu.RUnlock()
+
+	for _, o := range observers {
+		o.fn(from, to)
+	}
+
+	if watch != nil {
+		select {
+		case watch <- Transition{From: from, To: to}:
+		default:
+		}
+	}
 }
 
 func (sm *StateManager) Add(s State) {
-	name := StateName(s)
+	sm.addNamed(StateName(s), s)
+}
+
+// 以指定的名字注册状态, Add 按反射得到的类型名调用它, 从定义文件加载时按文件里写的名字调用它
+func (sm *StateManager) addNamed(name string, s State) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
 
 	// 将 s 转换为能设置名字的接口, 然后调用该接口
 	s.(interface {
 		setName(name string)
 	}).setName(name)
 
-	if sm.Get(name) != nil {
+	if _, ok := sm.stateByName[name]; ok {
 		panic("duplicate state: " + name)
 	}
 
@@ -90,6 +369,9 @@ func (sm *StateManager) Add(s State) {
 }
 
 func (sm *StateManager) Get(name string) State {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
 	if v, ok := sm.stateByName[name]; ok {
 		return v
 	}
@@ -100,6 +382,85 @@ func (sm *StateManager) Get(name string) State {
 func NewStateManager() *StateManager {
 	return &StateManager{
 		stateByName: make(map[string]State),
+		events:      make(chan Event, eventQueueSize),
+		HistoryCap:  defaultTransitionHistory,
+	}
+}
+
+// 没有为当前状态下的该事件注册处理器
+var ErrNoEventHandler = fmt.Errorf("no handler registered for event.")
+
+// 注册 stateName 状态下对 eventName 事件的处理器, 处理器返回下一个要转移到的状态名
+// (返回空字符串表示这次事件不触发转移), 同一个事件在不同状态下可以注册不同的处理器
+func (sm *StateManager) OnEvent(stateName, eventName string, handler func(payload interface{}) (nextState string, err error)) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if sm.eventHandlers == nil {
+		sm.eventHandlers = make(map[string]map[string]func(interface{}) (string, error))
+	}
+
+	if sm.eventHandlers[stateName] == nil {
+		sm.eventHandlers[stateName] = make(map[string]func(interface{}) (string, error))
+	}
+
+	sm.eventHandlers[stateName][eventName] = handler
+}
+
+// 投递一个事件, 只是把它放进队列, 真正的处理在 Run 里进行
+func (sm *StateManager) Fire(name string, payload interface{}) {
+	sm.events <- Event{Name: name, Payload: payload}
+}
+
+// 按当前状态和事件名找到处理器并执行, 如果处理器要求转移就调用 Transit
+func (sm *StateManager) dispatchEvent(ev Event) error {
+	sm.mu.RLock()
+	from := ""
+	if sm.curr != nil {
+		from = sm.curr.Name()
+	}
+	handler, ok := sm.eventHandlers[from][ev.Name]
+	sm.mu.RUnlock()
+
+	if !ok {
+		return ErrNoEventHandler
+	}
+
+	next, err := handler(ev.Payload)
+	if err != nil {
+		return err
+	}
+
+	if next == "" {
+		return nil
+	}
+
+	return sm.Transit(next)
+}
+
+// 驱动事件循环, 直到 ctx 被取消. 取消之后会先把已经排队的事件处理完再返回,
+// 这样 Fire 在 OnBegin/OnEnd 里投递的事件不会被丢弃
+func (sm *StateManager) Run(ctx context.Context) {
+	for {
+		select {
+		case ev := <-sm.events:
+			sm.reportEventError(ev, sm.dispatchEvent(ev))
+		case <-ctx.Done():
+			for {
+				select {
+				case ev := <-sm.events:
+					sm.reportEventError(ev, sm.dispatchEvent(ev))
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (sm *StateManager) reportEventError(ev Event, err error) {
+	if err != nil && sm.OnEventError != nil {
+		sm.OnEventError(ev, err)
 	}
 }
 
@@ -114,49 +475,252 @@ var ErrCannotTransitToState = fmt.Errorf("cannot transit to state.")
 
 // 获取当前状态
 func (sm *StateManager) CurrState() State {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
 	return sm.curr
 }
 
+// History 返回最近发生的转移记录(最多 HistoryCap 条), 按发生顺序排列
+func (sm *StateManager) History() []TransitionRecord {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	return append([]TransitionRecord(nil), sm.records...)
+}
+
+// TimeInState 返回状态 name 到目前为止的累计停留时长, 不包含还未结束的当前这次停留
+func (sm *StateManager) TimeInState(name string) time.Duration {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	return sm.timeInState[name]
+}
+
 // 当前状态能够转移到目标状态
 func (sm *StateManager) CanCurrTransitTo(name string) bool {
-	if sm.curr == nil {
+	sm.mu.RLock()
+	curr := sm.curr
+	chain := sm.activeChain
+	sm.mu.RUnlock()
+
+	if curr == nil {
 		return true
 	}
 
-	if sm.curr.Name() == name && !sm.curr.EnableSameTransit() {
+	if curr.Name() == name && !curr.EnableSameTransit() {
 		return false
 	}
 
-	// 使用当前状态
-	return sm.curr.CanTransitTo(name)
+	if rules := sm.transitionRulesTo(curr.Name(), name); len(rules) > 0 {
+		for _, m := range rules {
+			if m.Rule.Guard != nil && !m.Rule.Guard() {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	// 使用当前状态所在的链(从叶子到根)判断
+	return chainCanTransitTo(chain, name)
+}
+
+// Parent() 配置成了环(比如 A.Parent()=="B" 且 B.Parent()=="A", 或状态把自己的名字配置成
+// 自己的 Parent()), chainOf 不可能正常终结
+var ErrStateHierarchyCycle = fmt.Errorf("state hierarchy has a cycle.")
+
+// 从 s 开始沿 Parent() 往上走, 返回从根到 s 的状态链. 一条合法的链最长不会超过已注册状态
+// 的个数, 走到这个深度还没有到根就说明 Parent() 配置成了环, 返回 ErrStateHierarchyCycle
+// 而不是死循环下去
+func (sm *StateManager) chainOf(s State) ([]State, error) {
+	sm.mu.RLock()
+	maxDepth := len(sm.stateByName) + 1
+	sm.mu.RUnlock()
+
+	var chain []State
+	for s != nil {
+		if len(chain) >= maxDepth {
+			return nil, ErrStateHierarchyCycle
+		}
+
+		chain = append([]State{s}, chain...)
+
+		parentName := s.Parent()
+		if parentName == "" {
+			break
+		}
+
+		s = sm.Get(parentName)
+	}
+
+	return chain, nil
+}
+
+// CanTransitTo 是否被子类重写过, 没有重写的话就沿链往上找重写过的祖先
+var defaultCanTransitTo = reflect.ValueOf((&StateInfo{}).CanTransitTo).Pointer()
+
+func overridesCanTransitTo(s State) bool {
+	return reflect.ValueOf(s.CanTransitTo).Pointer() != defaultCanTransitTo
+}
+
+// 沿激活链从叶子往根找, 使用第一个重写过 CanTransitTo 的状态的判断结果,
+// 这样子状态没有重写时就继承父状态的转移守卫. 是个纯函数, 调用者负责拿到一份一致的链
+func chainCanTransitTo(chain []State, name string) bool {
+	for i := len(chain) - 1; i >= 0; i-- {
+		s := chain[i]
+		if overridesCanTransitTo(s) {
+			return s.CanTransitTo(name)
+		}
+	}
+
+	return true
 }
 
+// Transit 对同一个 StateManager 的并发调用是串行化的, 一次转移的 OnEnd/OnBegin/action/
+// 观察者不会和另一次转移交错执行
 func (sm *StateManager) Transit(name string) error {
+	sm.transitMu.Lock()
+	defer sm.transitMu.Unlock()
+
 	next := sm.Get(name)
 	if next == nil {
 		return ErrStateNotFound
 	}
 
-	pre := sm.curr
-	if sm.curr != nil {
-		if sm.curr.Name() == name && !sm.curr.EnableSameTransit() {
+	sm.mu.RLock()
+	curr := sm.curr
+	chain := sm.activeChain
+	enteredAt := sm.enteredAt
+	sm.mu.RUnlock()
+
+	fromName := ""
+	if curr != nil {
+		fromName = curr.Name()
+	}
+
+	// 守卫针对调用者请求的状态名判断, 历史记忆只影响实际进入的子状态
+	rules := sm.transitionRulesTo(fromName, next.Name())
+
+	if curr != nil {
+		if curr.Name() == next.Name() && !curr.EnableSameTransit() {
 			return ErrForbidSameStateTransit
 		}
 
-		if !sm.curr.CanTransitTo(name) {
+		if len(rules) > 0 {
+			// 声明式转移表优先于状态自身的 CanTransitTo
+			for _, m := range rules {
+				if m.Rule.Guard != nil && !m.Rule.Guard() {
+					return &TransitionRejectedError{
+						From:      fromName,
+						To:        next.Name(),
+						RuleIndex: m.Index,
+						GuardName: sm.guardName(m.Rule.Guard),
+					}
+				}
+			}
+		} else if !chainCanTransitTo(chain, next.Name()) {
 			return ErrCannotTransitToState
 		}
+	}
 
-		sm.curr.OnEnd()
+	// 复合状态本身不是合法的叶子状态: 如果它启用了历史记忆并且之前记录过离开时的子状态,
+	// 重新进入那个子状态; 否则回到它配置的初始子状态. 两者都没有命中时按原样进入 next,
+	// 它要么是叶子状态, 要么是没有配置初始子状态的复合状态(由调用方负责保证这是合理的)
+	if next.EnableHistory() {
+		sm.mu.RLock()
+		childName, ok := sm.history[next.Name()]
+		sm.mu.RUnlock()
+
+		if ok {
+			if child := sm.Get(childName); child != nil {
+				next = child
+			}
+		}
+	}
+
+	if initial := next.InitialChild(); initial != "" {
+		if child := sm.Get(initial); child != nil {
+			next = child
+		}
+	}
+
+	pre := curr
+	targetChain, err := sm.chainOf(next)
+	if err != nil {
+		return err
+	}
+
+	// 找到当前链和目标链的最近公共祖先(lca), 它之后的部分才需要 OnEnd/OnBegin
+	lca := 0
+	for lca < len(chain) && lca < len(targetChain) &&
+		chain[lca].Name() == targetChain[lca].Name() {
+		lca++
+	}
+
+	// 由内向外退出: 从叶子退到 lca, 沿途记录启用了历史记忆的父状态
+	for i := len(chain) - 1; i >= lca; i-- {
+		s := chain[i]
+		s.OnEnd()
+
+		if i > 0 {
+			parent := chain[i-1]
+			if parent.EnableHistory() {
+				sm.mu.Lock()
+				if sm.history == nil {
+					sm.history = make(map[string]string)
+				}
+				sm.history[parent.Name()] = s.Name()
+				sm.mu.Unlock()
+			}
+		}
+	}
+
+	// 声明式转移表里挂的 action, 在 OnEnd 和 OnBegin 之间按注册顺序执行
+	for _, m := range rules {
+		if m.Rule.Action != nil {
+			m.Rule.Action()
+		}
 	}
 
+	// 由外向内进入: 从 lca 进到目标叶子
+	for i := lca; i < len(targetChain); i++ {
+		targetChain[i].OnBegin()
+	}
+
+	now := time.Now()
+
+	var inPreState time.Duration
+	if pre != nil {
+		inPreState = now.Sub(enteredAt)
+	}
+
+	sm.mu.Lock()
 	sm.curr = next
-	sm.curr.OnBegin()
+	sm.activeChain = targetChain
+	sm.enteredAt = now
+
+	if pre != nil {
+		if sm.timeInState == nil {
+			sm.timeInState = make(map[string]time.Duration)
+		}
+		sm.timeInState[fromName] += inPreState
+	}
 
-	if sm.OnChange != nil {
-		sm.OnChange(pre, sm.curr)
+	historyCap := sm.HistoryCap
+	if historyCap <= 0 {
+		historyCap = defaultTransitionHistory
 	}
 
+	sm.records = append(sm.records, TransitionRecord{From: fromName, To: next.Name(), At: now, Duration: inPreState})
+	if len(sm.records) > historyCap {
+		sm.records = sm.records[len(sm.records)-historyCap:]
+	}
+	sm.mu.Unlock()
+
+	// 观察者在 OnBegin 返回之后, 按注册顺序被调用
+	sm.notify(pre, next)
+
 	return nil
 }
 
@@ -188,6 +752,48 @@ func (i *MoveState) EnableSameTransit() bool {
 	return true
 }
 
+// MoveState 是一个复合状态, 记住最近一次激活的子状态(Walk/Run)
+func (i *MoveState) EnableHistory() bool {
+	return true
+}
+
+// 还没有历史记忆时(第一次进入 MoveState), 默认从 WalkState 开始
+func (i *MoveState) InitialChild() string {
+	return "WalkState"
+}
+
+type WalkState struct {
+	StateInfo
+}
+
+func (w *WalkState) Parent() string {
+	return "MoveState"
+}
+
+func (w *WalkState) OnBegin() {
+	fmt.Println("WalkState begin")
+}
+
+func (w *WalkState) OnEnd() {
+	fmt.Println("WalkState end")
+}
+
+type RunState struct {
+	StateInfo
+}
+
+func (r *RunState) Parent() string {
+	return "MoveState"
+}
+
+func (r *RunState) OnBegin() {
+	fmt.Println("RunState begin")
+}
+
+func (r *RunState) OnEnd() {
+	fmt.Println("RunState end")
+}
+
 type JumpState struct {
 	StateInfo
 }
@@ -206,20 +812,167 @@ func (i *JumpState) CanTransitTo(name string) bool {
 
 func main() {
 	sm := NewStateManager()
-	sm.OnChange = func(from, to State) {
+	sm.Subscribe(func(from, to State) {
 		fmt.Printf("%s ---> %s\n", StateName(from), StateName(to))
-	}
+	})
 
 	sm.Add(new(IdleState))
 	sm.Add(new(MoveState))
+	sm.Add(new(WalkState))
+	sm.Add(new(RunState))
 	sm.Add(new(JumpState))
 
+	// 声明式转移表: 跳跃需要消耗体力, 体力耗尽前由该规则的 guard 放行
+	stamina := 1
+	sm.AddTransition("RunState", "JumpState", func() bool {
+		return stamina > 0
+	}, func() {
+		stamina--
+		fmt.Println("action: consumed a jump charge, stamina left:", stamina)
+	})
+	sm.AddTransitionAny("IdleState", nil, func() {
+		fmt.Println("action: settling back to idle")
+	})
+
 	transitAndReport(sm, "IdleState")
+	// MoveState 还没有历史记忆, 这里会自动进入它配置的初始子状态 WalkState
 	transitAndReport(sm, "MoveState")
+	transitAndReport(sm, "RunState")
+	transitAndReport(sm, "IdleState")
+	// MoveState 启用了历史记忆, 这里会直接回到离开前的 RunState, 而不是 MoveState 自身
 	transitAndReport(sm, "MoveState")
+	fmt.Println("possible transitions:", sm.PossibleTransitions())
 	transitAndReport(sm, "JumpState")
 	transitAndReport(sm, "JumpState")
 	transitAndReport(sm, "IdleState")
+	transitAndReport(sm, "MoveState")
+	// 体力已耗尽, 声明式转移表的 guard 会拒绝这次跳跃
+	transitAndReport(sm, "JumpState")
+
+	fmt.Println()
+	fmt.Println("--- event-driven demo ---")
+	transitAndReport(sm, "IdleState")
+
+	sm.OnEventError = func(ev Event, err error) {
+		fmt.Printf("event %q failed: %s\n", ev.Name, err.Error())
+	}
+
+	// 同一个 "action" 事件, 在不同状态下触发不同的转移(Mealy machine):
+	// 空闲时 action 表示开始移动(历史记忆会带回上次的 RunState), 移动时 action 表示停下
+	sm.OnEvent("IdleState", "action", func(payload interface{}) (string, error) {
+		return "MoveState", nil
+	})
+	sm.OnEvent("RunState", "action", func(payload interface{}) (string, error) {
+		return "IdleState", nil
+	})
+
+	sm.Fire("action", nil)
+	sm.Fire("action", nil)
+	// IdleState 没有注册 "mystery" 事件的处理器
+	sm.Fire("mystery", nil)
+
+	// 事件都已经排队, 这里驱动一轮事件循环把它们处理掉
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	sm.Run(ctx)
+
+	fmt.Println()
+	fmt.Println("--- import/export demo ---")
+
+	data, err := json.Marshal(sm)
+	if err != nil {
+		fmt.Println("export failed:", err)
+		return
+	}
+	fmt.Println("exported:", string(data))
+
+	factories := NewFactoryRegistry()
+	factories.Register("IdleState", func() State { return new(IdleState) })
+	factories.Register("MoveState", func() State { return new(MoveState) })
+	factories.Register("WalkState", func() State { return new(WalkState) })
+	factories.Register("RunState", func() State { return new(RunState) })
+	factories.Register("JumpState", func() State { return new(JumpState) })
+
+	loaded := NewStateManager()
+	loaded.Factories = factories
+
+	if err := json.Unmarshal(data, loaded); err != nil {
+		fmt.Println("import failed:", err)
+		return
+	}
+
+	fmt.Println("re-imported current state:", loaded.CurrState().Name())
+
+	fmt.Println()
+	fmt.Println("--- concurrency demo ---")
+
+	concurrent := NewStateManager()
+	concurrent.Add(new(IdleState))
+	concurrent.Add(new(MoveState))
+	concurrent.Add(new(JumpState))
+	transitAndReport(concurrent, "IdleState")
+
+	var seen int32
+	unsubscribe := concurrent.Subscribe(func(from, to State) {
+		atomic.AddInt32(&seen, 1)
+	})
+	watch := concurrent.Watch()
+
+	// 多个 goroutine 并发调用 Transit, 不会交错执行 OnEnd/OnBegin
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			concurrent.Transit("MoveState")
+			concurrent.Transit("IdleState")
+		}()
+	}
+	wg.Wait()
+	unsubscribe()
+
+	fmt.Println("subscriber observed", atomic.LoadInt32(&seen), "transitions")
+
+	watched := 0
+drain:
+	for {
+		select {
+		case <-watch:
+			watched++
+		default:
+			break drain
+		}
+	}
+	fmt.Println("Watch() delivered", watched, "transitions")
+
+	fmt.Println()
+	fmt.Println("--- history & metrics demo ---")
+
+	observed := NewStateManager()
+	// 只保留最近 2 条转移记录, 演示 HistoryCap 是可以按需调小的
+	observed.HistoryCap = 2
+	observed.Add(new(IdleState))
+	observed.Add(new(MoveState))
+	observed.Add(new(JumpState))
+	observed.AddTransition("IdleState", "JumpState", nil, nil)
+
+	transitAndReport(observed, "IdleState")
+	time.Sleep(10 * time.Millisecond)
+	transitAndReport(observed, "JumpState")
+	time.Sleep(5 * time.Millisecond)
+	transitAndReport(observed, "IdleState")
+
+	for _, rec := range observed.History() {
+		fmt.Printf("history: %s -> %s, spent %s in %s\n", rec.From, rec.To, rec.Duration, rec.From)
+	}
+	fmt.Println("time in IdleState so far:", observed.TimeInState("IdleState"))
+
+	fmt.Println()
+	fmt.Println("--- Graphviz export demo ---")
+
+	if err := observed.ExportDOT(os.Stdout); err != nil {
+		fmt.Println("dot export failed:", err)
+	}
 }
 
 func transitAndReport(sm *StateManager, target string) {
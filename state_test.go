@@ -0,0 +1,154 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// raceProbe 是两个测试专用叶子状态共享的行为: OnBegin/OnEnd 往外部计数器里记一笔,
+// 用来在 -race 下既检测数据竞争, 也检测 Transit 是否真的串行化了
+type raceProbe struct {
+	StateInfo
+	active  *int32
+	maxSeen *int32
+}
+
+func (p *raceProbe) OnBegin() { p.mark(1) }
+func (p *raceProbe) OnEnd()   { p.mark(-1) }
+
+// mark 记录当前同时处于 OnBegin/OnEnd 执行期间的 goroutine 数, 如果 Transit 没有串行化,
+// 这个数会在某个时刻大于 1
+func (p *raceProbe) mark(delta int32) {
+	n := atomic.AddInt32(p.active, delta)
+	if delta <= 0 {
+		return
+	}
+
+	for {
+		m := atomic.LoadInt32(p.maxSeen)
+		if n <= m || atomic.CompareAndSwapInt32(p.maxSeen, m, n) {
+			return
+		}
+	}
+}
+
+type raceStateA struct{ raceProbe }
+type raceStateB struct{ raceProbe }
+
+func newRaceManager(active, maxSeen *int32) *StateManager {
+	sm := NewStateManager()
+	sm.Add(&raceStateA{raceProbe{active: active, maxSeen: maxSeen}})
+	sm.Add(&raceStateB{raceProbe{active: active, maxSeen: maxSeen}})
+
+	return sm
+}
+
+// Transit 对同一个 StateManager 的并发调用必须串行化, 两次转移的 OnEnd/OnBegin 不能交错
+// 执行, 用 go test -race 跑才能同时抓到数据竞争和交错执行
+func TestTransitConcurrentDoesNotInterleave(t *testing.T) {
+	var active, maxSeen int32
+
+	sm := newRaceManager(&active, &maxSeen)
+	if err := sm.Transit("raceStateA"); err != nil {
+		t.Fatalf("initial transit failed: %v", err)
+	}
+
+	const goroutines = 8
+	const rounds = 50
+
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < rounds; j++ {
+				sm.Transit("raceStateB")
+				sm.Transit("raceStateA")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&maxSeen); got > 1 {
+		t.Fatalf("Transit calls interleaved: observed %d OnBegin/OnEnd running at once, want at most 1", got)
+	}
+}
+
+// Subscribe/Watch 在 Transit 并发发生时仍然要给出一致的结果: 观察者收到的通知数应该
+// 恰好等于成功的转移数, 并发调用 Subscribe/unsubscribe 也不应该和 Transit 竞争 observers
+func TestConcurrentTransitSubscribeWatch(t *testing.T) {
+	var active, maxSeen int32
+
+	sm := newRaceManager(&active, &maxSeen)
+	if err := sm.Transit("raceStateA"); err != nil {
+		t.Fatalf("initial transit failed: %v", err)
+	}
+
+	var seen int32
+	unsubscribe := sm.Subscribe(func(from, to State) {
+		atomic.AddInt32(&seen, 1)
+	})
+	defer unsubscribe()
+
+	watch := sm.Watch()
+
+	const goroutines = 8
+	const rounds = 50
+
+	// 8 个 goroutine 互相竞争同一对状态, 谁先把 curr 切过去, 其他人再发起同样的转移就会被
+	// EnableSameTransit==false 拒绝, 所以真正成功的转移次数本来就小于 goroutines*rounds*2,
+	// 用一个计数器记录实际成功的次数, 而不是假设每次调用都会成功
+	var succeeded int32
+
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < rounds; j++ {
+				if sm.Transit("raceStateB") == nil {
+					atomic.AddInt32(&succeeded, 1)
+				}
+				if sm.Transit("raceStateA") == nil {
+					atomic.AddInt32(&succeeded, 1)
+				}
+			}
+		}()
+	}
+
+	// 并发地订阅又立刻取消订阅, 验证 observers 切片的增删在 -race 下是安全的
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for j := 0; j < rounds; j++ {
+			u := sm.Subscribe(func(State, State) {})
+			u()
+		}
+	}()
+
+	wg.Wait()
+
+	want := atomic.LoadInt32(&succeeded)
+	if got := atomic.LoadInt32(&seen); got != want {
+		t.Fatalf("subscriber observed %d transitions, want %d (the number of Transit calls that actually succeeded)", got, want)
+	}
+
+	drained := 0
+drain:
+	for {
+		select {
+		case <-watch:
+			drained++
+		default:
+			break drain
+		}
+	}
+
+	if int32(drained) > want {
+		t.Fatalf("Watch() delivered %d transitions, more than the %d that actually happened", drained, want)
+	}
+}